@@ -0,0 +1,58 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package network provides network related helpers used throughout
+// Knative, including the headers and user agents used to implement
+// Knative's system of probes and health checks.
+package network
+
+import "time"
+
+const (
+	// UserAgentKey is the header key for user agent.
+	UserAgentKey = "User-Agent"
+
+	// KubeProbeUAPrefix is the user agent prefix set by kubelet probes.
+	KubeProbeUAPrefix = "kube-probe/"
+
+	// ProbeHeaderName is the name of a header that can be added to
+	// requests to probe the knative networking layer.  Requests
+	// with this header will not be passed to the user container or
+	// included in request metrics.
+	ProbeHeaderName = "K-Network-Probe"
+
+	// ProbeHeaderValue is the value for network probe.
+	ProbeHeaderValue = "queue"
+
+	// HashHeaderName is the name of an internal header that Knative
+	// uses to verify that a probe actually reached the intended pod.
+	HashHeaderName = "K-Network-Hash"
+
+	// HashHandlerHeaderName is the name of an internal header that
+	// identifies which component answered a K-Network-Hash probe (e.g.
+	// the app itself, queue-proxy, or the activator), so upstream
+	// provers can tell whose response they got.
+	HashHandlerHeaderName = "K-Network-Hash-Handler"
+
+	// ActivatorUserAgent is the user agent the activator uses when it
+	// probes a revision directly.
+	ActivatorUserAgent = "Knative-Activator-Probe"
+
+	// DefaultDrainTimeout is the default time given to a revision's
+	// Pods to drain connections after being marked not-ready before
+	// they are killed.
+	DefaultDrainTimeout = 30 * time.Second
+)
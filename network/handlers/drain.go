@@ -0,0 +1,517 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package handlers contains handlers that add support for Knative-specific
+// features on top of a regular http.Handler.
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/errors"
+	"knative.dev/pkg/network"
+)
+
+// timer is the interface implemented by the clock used to drive the quiet
+// period between the last observed request and the completion of Drain.
+// It exists so tests can substitute a fake clock for time.Timer.
+type timer interface {
+	Reset(d time.Duration) bool
+	Stop() bool
+	tickChan() <-chan time.Time
+}
+
+// wrappedTimer adapts a *time.Timer to the timer interface.
+type wrappedTimer struct {
+	*time.Timer
+}
+
+func (w *wrappedTimer) tickChan() <-chan time.Time {
+	return w.C
+}
+
+// newTimer is overridden in tests to inject a fake timer.
+var newTimer = func(d time.Duration) timer {
+	return &wrappedTimer{time.NewTimer(d)}
+}
+
+// Drainer wraps an inner http.Handler to support responding to kubelet
+// probes and Knative network probes with a 200 until the handler is told
+// to Drain, i.e. it is in the process of being shut down, at which point
+// it starts failing those same probes (while continuing to serve regular
+// traffic) until Reset, and Drain blocks until no request has been observed
+// for QuietPeriod, so that k8s has time to program the change out of the
+// Service's endpoints before the process actually exits.
+type Drainer struct {
+	sync.RWMutex
+
+	// QuietPeriod is the duration that Drain will wait for the last
+	// request to have been observed before returning. If unset,
+	// network.DefaultDrainTimeout is used.
+	QuietPeriod time.Duration
+
+	// LameDuckPeriod is the duration Drain sleeps, immediately after
+	// marking the Drainer as draining (so that probes and health checks
+	// start failing right away), before it arms the QuietPeriod timer.
+	// It gives Kubernetes time to propagate the pod's removal from
+	// Service endpoints while still serving real traffic, so that a
+	// burst of in-flight requests arriving right at shutdown can't keep
+	// resetting the quiet-period timer before that propagation happens.
+	LameDuckPeriod time.Duration
+
+	// Inner is the http.Handler to which we delegate actual serving,
+	// for requests that aren't probes.
+	Inner http.Handler
+
+	// HealthCheckUAPrefixes is a list of additional user agent prefixes
+	// that should be treated as health checks, on top of the standard
+	// kubelet kube-probe prefix.
+	HealthCheckUAPrefixes []string
+
+	// HealthCheck is an optional handler for serving health checks (the
+	// kube-probes and HealthCheckUAPrefixes matches) while not draining.
+	// If unset, such probes are answered directly with a 200.
+	HealthCheck http.Handler
+
+	// Prober, if set alongside ProbeHash, is used by Drain to confirm
+	// that every upstream target passed to it (e.g. a mesh sidecar or
+	// the activator) has observed this pod's draining state before
+	// Drain returns, closing the propagation race where a pod stops
+	// accepting traffic before its upstreams have noticed.
+	Prober *Prober
+
+	// ProbeHash is the value upstream targets are expected to echo back
+	// via K-Network-Hash once they have propagated this pod's draining
+	// state, e.g. a per-revision or per-pod identifier.
+	ProbeHash string
+
+	// ProbeBackoff configures the retry backoff Drain uses when probing
+	// targets. The zero value uses DefaultProbeBackoff.
+	ProbeBackoff ProbeBackoff
+
+	// Probes is evaluated, in order, ahead of the built-in KProbe and
+	// KubeProbe matchers ServeHTTP always appends (configured from
+	// HealthCheckUAPrefixes and HealthCheck), letting callers plug in
+	// custom load-balancer health check formats - or override the
+	// built-ins outright - without forking ServeHTTP.
+	Probes []ProbeMatcher
+
+	// MaxDrainDuration bounds the total time Drain will wait, regardless
+	// of whether requests are still in-flight once the QuietPeriod has
+	// otherwise elapsed. This guards against long-lived HTTP/2, SSE, or
+	// gRPC streams that would prevent a purely wall-clock quiet period
+	// from ever being satisfied. Zero means no hard ceiling.
+	MaxDrainDuration time.Duration
+
+	// OnForceClose, if set, is invoked with the requests Drainer still
+	// considers in-flight when MaxDrainDuration elapses before they
+	// finished on their own.
+	OnForceClose func([]*http.Request)
+
+	// draining is true from the first call to Drain until Reset,
+	// independent of whether the QuietPeriod timer has been armed yet:
+	// it flips true immediately so probes and health checks start
+	// failing, even while a LameDuckPeriod sleep is holding off arming
+	// the timer itself.
+	draining bool
+
+	// lameDuckDone is closed once the LameDuckPeriod sleep (if any) for
+	// the current drain cycle has elapsed, letting every caller of
+	// Drain wait on the same sleep rather than racing to skip it.
+	lameDuckDone chan struct{}
+
+	// resetCh is closed by Reset to abort a drain cycle that is still
+	// sleeping out LameDuckPeriod, i.e. before startDraining has armed a
+	// timer for Reset to stop. Without it, a goroutine already blocked on
+	// the now-orphaned lameDuckDone from a prior cycle would wake up once
+	// that sleep elapses and resurrect a drain cycle Reset already ended.
+	resetCh chan struct{}
+
+	// deadlineCh fires once MaxDrainDuration has elapsed since the
+	// first call to Drain for the current drain cycle, regardless of
+	// whether the LameDuckPeriod sleep or QuietPeriod timer are done.
+	deadlineCh <-chan time.Time
+
+	// timer tracks the QuietPeriod once it has been armed. It is nil
+	// until Drain arms it, which it does only after the LameDuckPeriod
+	// sleep (if any) has elapsed.
+	timer timer
+
+	// drainCh is closed once the quiet period has elapsed (or Reset has
+	// been called), after which Drain goes on to wait for in-flight
+	// requests to finish.
+	drainCh chan struct{}
+
+	// inflightMu guards inflightReqs.
+	inflightMu sync.Mutex
+
+	// inflightReqs is the set of requests ServeHTTP has observed enter
+	// Inner that have not yet finished.
+	inflightReqs map[*http.Request]struct{}
+
+	// inflightWG reaches zero once every request tracked in
+	// inflightReqs has finished.
+	inflightWG sync.WaitGroup
+}
+
+// ServeHTTP implements http.Handler.
+func (d *Drainer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.RLock()
+	draining := d.draining
+	t := d.timer
+	probes := d.effectiveProbes()
+	d.RUnlock()
+
+	for _, m := range probes {
+		if m.Matches(r) {
+			m.Serve(w, r, draining)
+			return
+		}
+	}
+
+	// A real (non-probe) request was observed while draining, so push
+	// back the deadline for the quiet period. Stop before Reset since
+	// the timer may or may not have already fired. The timer may still
+	// be nil here if we're in the LameDuckPeriod sleep, which hasn't
+	// armed it yet; there's nothing to push back in that case.
+	if draining && t != nil {
+		t.Stop()
+		t.Reset(d.quietPeriod())
+	}
+
+	done := d.trackRequest(r)
+	base := &inFlightWriter{ResponseWriter: w, done: done}
+	defer func() {
+		if !base.hijacked {
+			done()
+		}
+	}()
+
+	d.Inner.ServeHTTP(wrapInFlightWriter(base, w), r)
+}
+
+// Drain marks the Drainer as draining (so probes and health checks start
+// failing immediately), sleeps out LameDuckPeriod while continuing to
+// serve real traffic, and only then arms the QuietPeriod timer. It
+// blocks until either (a) QuietPeriod has elapsed since the last request
+// was observed and every in-flight request has finished, or (b)
+// MaxDrainDuration has elapsed since this first call, whichever comes
+// first. Holding off the timer until after LameDuckPeriod means a burst
+// of in-flight requests arriving right at shutdown can't keep resetting
+// the quiet-period countdown before Kubernetes has had a chance to
+// propagate the pod's removal from Service endpoints. (b) exists because
+// a long-lived HTTP/2, SSE, or gRPC stream can hold the in-flight count
+// above zero indefinitely, and a pure wall-clock quiet period can't
+// detect that. Multiple concurrent (or sequential) calls to Drain all
+// wait on the same underlying state and return together.
+//
+// If targets are given and Prober is set, Drain also probes every target
+// concurrently with the above and does not return until each of them has
+// echoed back ProbeHash, reporting any that never did. When (b) ends the
+// wait, Drain returns without waiting for outstanding probes.
+func (d *Drainer) Drain(targets ...string) error {
+	lameDuckDone, resetCh, deadline := d.beginDraining()
+
+	var probeErr error
+	probeDone := make(chan struct{})
+	if len(targets) > 0 && d.Prober != nil {
+		go func() {
+			defer close(probeDone)
+			probeErr = d.probeUpstreams(targets)
+		}()
+	} else {
+		close(probeDone)
+	}
+
+	quiesced := make(chan struct{})
+	go func() {
+		defer close(quiesced)
+		select {
+		case <-lameDuckDone:
+		case <-resetCh:
+			// Reset aborted us before we got to arm the QuietPeriod
+			// timer; there's nothing more to wait on.
+			return
+		}
+		c := d.startDraining()
+		<-c
+		d.inflightWG.Wait()
+	}()
+
+	select {
+	case <-quiesced:
+		<-probeDone
+	case <-deadline:
+		if d.OnForceClose != nil {
+			d.OnForceClose(d.inFlightRequests())
+		}
+	}
+
+	log.Print("Done draining")
+	return probeErr
+}
+
+// beginDraining flips the Drainer into its draining state exactly once
+// per drain cycle (marking it so probes and health checks start failing
+// right away), arms MaxDrainDuration relative to now, and kicks off the
+// LameDuckPeriod sleep. It returns the channel that closes once that
+// sleep has elapsed, the channel Reset closes to abort the cycle before
+// that sleep elapses, and the hard deadline channel (nil if
+// MaxDrainDuration is unset) — all safe for any number of callers to
+// wait on.
+func (d *Drainer) beginDraining() (chan struct{}, chan struct{}, <-chan time.Time) {
+	d.Lock()
+	if d.draining {
+		ldc, rc, deadline := d.lameDuckDone, d.resetCh, d.deadlineCh
+		d.Unlock()
+		return ldc, rc, deadline
+	}
+
+	d.draining = true
+	ldc := make(chan struct{})
+	rc := make(chan struct{})
+	d.lameDuckDone = ldc
+	d.resetCh = rc
+	if d.MaxDrainDuration > 0 {
+		d.deadlineCh = time.After(d.MaxDrainDuration)
+	}
+	lameDuck, deadline := d.LameDuckPeriod, d.deadlineCh
+	d.Unlock()
+
+	if lameDuck > 0 {
+		go func() {
+			t := time.NewTimer(lameDuck)
+			defer t.Stop()
+			select {
+			case <-t.C:
+				close(ldc)
+			case <-rc:
+				// Reset fired first; nothing more for us to do.
+			}
+		}()
+	} else {
+		close(ldc)
+	}
+	return ldc, rc, deadline
+}
+
+// probeUpstreams probes every target concurrently and aggregates the
+// errors from any that didn't confirm ProbeHash.
+func (d *Drainer) probeUpstreams(targets []string) error {
+	backoff := d.ProbeBackoff
+	if backoff == (ProbeBackoff{}) {
+		backoff = DefaultProbeBackoff
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(targets))
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target string) {
+			defer wg.Done()
+			ok, err := d.Prober.Do(context.Background(), backoff, target, d.ProbeHash)
+			switch {
+			case err != nil:
+				errs[i] = err
+			case !ok:
+				errs[i] = fmt.Errorf("upstream %s did not observe draining state", target)
+			}
+		}(i, target)
+	}
+	wg.Wait()
+	return errors.NewAggregate(errs)
+}
+
+// startDraining arms the quiet-period timer (unless one is already
+// running), and returns the channel that closes once the quiet period elapses or Reset is called.
+// If Reset has already ended the drain cycle by the time this is called
+// (e.g. it raced the LameDuckPeriod sleep), it returns an already-closed
+// channel rather than resurrecting a cycle the caller no longer owns.
+func (d *Drainer) startDraining() chan struct{} {
+	d.Lock()
+	if !d.draining {
+		d.Unlock()
+		c := make(chan struct{})
+		close(c)
+		return c
+	}
+	if d.timer != nil {
+		c := d.drainCh
+		d.Unlock()
+		return c
+	}
+
+	t := newTimer(d.quietPeriod())
+	c := make(chan struct{})
+	d.timer = t
+	d.drainCh = c
+	d.Unlock()
+
+	log.Print("Starting to drain")
+	go func() {
+		<-t.tickChan()
+		d.closeDrainCh(c)
+	}()
+	return c
+}
+
+// Reset cancels an in-progress Drain, ending its LameDuckPeriod sleep and
+// QuietPeriod wait and allowing a subsequent Drain to start a fresh quiet
+// period. Callers blocked in Drain still wait for in-flight requests and
+// any upstream probes to finish (or MaxDrainDuration to elapse) before
+// returning. It is a no-op if Drain has not been called since the last
+// Reset.
+func (d *Drainer) Reset() {
+	d.Lock()
+	if !d.draining {
+		d.Unlock()
+		return
+	}
+	t, c, rc := d.timer, d.drainCh, d.resetCh
+	d.draining = false
+	d.lameDuckDone, d.deadlineCh, d.resetCh = nil, nil, nil
+	d.timer, d.drainCh = nil, nil
+	d.Unlock()
+
+	if t != nil {
+		t.Stop()
+	}
+	if rc != nil {
+		d.closeDrainCh(rc)
+	}
+	if c != nil {
+		d.closeDrainCh(c)
+	}
+}
+
+// closeDrainCh closes c if it hasn't been closed already, guarding against
+// the timer firing and Reset racing to signal completion of the same
+// drain cycle.
+func (d *Drainer) closeDrainCh(c chan struct{}) {
+	d.Lock()
+	defer d.Unlock()
+	select {
+	case <-c:
+		// Already closed.
+	default:
+		close(c)
+	}
+}
+
+func (d *Drainer) quietPeriod() time.Duration {
+	if d.QuietPeriod > 0 {
+		return d.QuietPeriod
+	}
+	return network.DefaultDrainTimeout
+}
+
+// effectiveProbes returns the matchers ServeHTTP consults, in order: any
+// caller-supplied d.Probes first, followed by the built-in KProbe and
+// KubeProbe matchers that implement Knative's own k-network-probe and
+// kube-probe handling, configured from d.HealthCheckUAPrefixes and
+// d.HealthCheck. Built-ins are appended rather than wired into ServeHTTP
+// directly so a caller-supplied matcher in d.Probes can still override
+// them.
+func (d *Drainer) effectiveProbes() []ProbeMatcher {
+	probes := make([]ProbeMatcher, 0, len(d.Probes)+2)
+	probes = append(probes, d.Probes...)
+	return append(probes,
+		KProbe{},
+		KubeProbe{UAPrefixes: d.HealthCheckUAPrefixes, HealthCheck: d.HealthCheck},
+	)
+}
+
+// matchesHealthCheckUA reports whether ua is kubelet's kube-probe user
+// agent, or matches one of the additional prefixes a caller configured.
+func matchesHealthCheckUA(ua string, prefixes []string) bool {
+	if strings.HasPrefix(ua, network.KubeProbeUAPrefix) {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(ua, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHealthCheckRequest identifies kubelet kube-probe requests, as well as
+// any additional user agent prefixes configured via HealthCheckUAPrefixes.
+func (d *Drainer) isHealthCheckRequest(r *http.Request) bool {
+	return matchesHealthCheckUA(r.Header.Get(network.UserAgentKey), d.HealthCheckUAPrefixes)
+}
+
+// isKProbe returns whether the given request is a Knative network probe.
+func isKProbe(r *http.Request) bool {
+	return r.Header.Get(network.ProbeHeaderName) == network.ProbeHeaderValue
+}
+
+// serveKProbe responds to a Knative network probe, echoing back the
+// K-Network-Hash header it was sent so the prober can verify it reached
+// the expected pod, and identifying itself as the component that
+// answered via K-Network-Hash-Handler.
+func serveKProbe(w http.ResponseWriter, r *http.Request) {
+	hash := r.Header.Get(network.HashHeaderName)
+	if hash == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Header().Set(network.HashHeaderName, hash)
+	w.Header().Set(network.HashHandlerHeaderName, "drainer")
+	w.WriteHeader(http.StatusOK)
+}
+
+// HealthHandler returns an http.Handler that serves 200 OK for as long as
+// the Drainer has not started draining, and 503 once Drain or Shutdown has
+// been called. Callers mount it at whatever liveness/readiness path their
+// platform expects (e.g. "/healthz"); it applies the same readiness signal
+// that ServeHTTP already gives to kube-probes, on a dedicated mux route.
+func (d *Drainer) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.RLock()
+		draining := d.draining
+		d.RUnlock()
+
+		if draining {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// Shutdown orchestrates a graceful shutdown of the given servers: it marks
+// the Drainer as draining so that probes start failing immediately
+// (letting Kubernetes remove the pod's endpoints), waits LameDuckPeriod
+// for that removal to propagate while continuing to serve real traffic,
+// blocks on Drain to let QuietPeriod elapse with no in-flight requests,
+// and then shuts each server down, aggregating any errors they return.
+//
+// It replaces the drain-then-shutdown boilerplate that is otherwise
+// duplicated in every binary that embeds a Drainer.
+func (d *Drainer) Shutdown(ctx context.Context, servers ...*http.Server) error {
+	errs := []error{d.Drain()}
+	for _, s := range servers {
+		errs = append(errs, s.Shutdown(ctx))
+	}
+	return errors.NewAggregate(errs)
+}
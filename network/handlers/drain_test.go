@@ -17,6 +17,8 @@ limitations under the License.
 package handlers
 
 import (
+	"context"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -491,6 +493,122 @@ func TestServeKProbe(t *testing.T) {
 	}
 }
 
+// TestLameDuckPeriodFailsProbesImmediately verifies that probes and health
+// checks start failing as soon as Drain is called, even before the
+// LameDuckPeriod sleep has elapsed and armed the QuietPeriod timer - and
+// that real traffic is still served normally during that sleep.
+func TestLameDuckPeriodFailsProbesImmediately(t *testing.T) {
+	var (
+		w     http.ResponseWriter
+		req   = &http.Request{}
+		probe = &http.Request{
+			Header: http.Header{
+				network.UserAgentKey: []string{network.KubeProbeUAPrefix},
+			},
+		}
+		cnt   = 0
+		inner = http.HandlerFunc(func(http.ResponseWriter, *http.Request) { cnt++ })
+	)
+
+	d := &Drainer{
+		Inner:          inner,
+		QuietPeriod:    10 * time.Millisecond,
+		LameDuckPeriod: 200 * time.Millisecond,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.Drain()
+	}()
+
+	// Give Drain a moment to mark us as draining, but stay well inside
+	// LameDuckPeriod so the QuietPeriod timer hasn't armed yet.
+	time.Sleep(20 * time.Millisecond)
+
+	d.RLock()
+	draining, timerArmed := d.draining, d.timer != nil
+	d.RUnlock()
+	if !draining {
+		t.Fatal("Drainer did not start draining immediately")
+	}
+	if timerArmed {
+		t.Fatal("QuietPeriod timer armed before LameDuckPeriod elapsed")
+	}
+
+	resp := httptest.NewRecorder()
+	d.ServeHTTP(resp, probe)
+	if got, want := resp.Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("Probe status = %d, want %d during LameDuckPeriod", got, want)
+	}
+
+	d.ServeHTTP(w, req)
+	if cnt != 1 {
+		t.Error("Inner handler was not invoked for real traffic during LameDuckPeriod")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Drain did not complete")
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	d := &Drainer{
+		QuietPeriod: time.Second,
+		Inner:       http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+	}
+	h := d.HealthHandler()
+
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, &http.Request{})
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Errorf("HealthHandler status = %d, want %d before Drain", got, want)
+	}
+
+	go d.Drain()
+	for i := 0; i < 100; i++ {
+		d.RLock()
+		draining := d.draining
+		d.RUnlock()
+		if draining {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, &http.Request{})
+	if got, want := resp.Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("HealthHandler status = %d, want %d while draining", got, want)
+	}
+
+	d.Reset()
+}
+
+func TestShutdown(t *testing.T) {
+	d := &Drainer{
+		QuietPeriod: 10 * time.Millisecond,
+		Inner:       http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Error opening listener:", err)
+	}
+	srv := &http.Server{Handler: d}
+	go srv.Serve(ln)
+
+	if err := d.Shutdown(context.Background(), srv); err != nil {
+		t.Errorf("Shutdown() = %v, want nil", err)
+	}
+
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Error("Dial to a shut down server succeeded, want an error")
+	}
+}
+
 func TestReset(t *testing.T) {
 	d := Drainer{
 		QuietPeriod: 5 * time.Second,
@@ -546,3 +664,55 @@ func TestReset(t *testing.T) {
 	// Calling reset after a drain should succeed
 	d.Reset()
 }
+
+func TestResetDuringLameDuck(t *testing.T) {
+	d := &Drainer{
+		QuietPeriod:    100 * time.Millisecond,
+		LameDuckPeriod: 300 * time.Millisecond,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.Drain()
+	}()
+
+	// Give Drain time to mark us as draining, but well before
+	// LameDuckPeriod elapses and arms the QuietPeriod timer.
+	time.Sleep(50 * time.Millisecond)
+	d.RLock()
+	draining := d.draining
+	timerArmed := d.timer != nil
+	d.RUnlock()
+	if !draining {
+		t.Fatal("Drainer did not start draining")
+	}
+	if timerArmed {
+		t.Fatal("QuietPeriod timer armed before LameDuckPeriod elapsed")
+	}
+
+	d.Reset()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Reset didn't unblock Drain during LameDuckPeriod")
+	}
+
+	d.RLock()
+	draining = d.draining
+	d.RUnlock()
+	if draining {
+		t.Error("Drainer still draining after Reset")
+	}
+
+	// A subsequent Drain should run a fresh QuietPeriod in full, rather
+	// than reusing a timer or drain channel left over from the aborted
+	// cycle above.
+	d.LameDuckPeriod = 0
+	start := time.Now()
+	d.Drain()
+	if got, want := time.Since(start), d.QuietPeriod; got < want {
+		t.Errorf("Drain returned after %v, want at least %v", got, want)
+	}
+}
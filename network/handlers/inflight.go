@@ -0,0 +1,151 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// trackRequest records r as in-flight and returns a function that marks
+// it as finished; the returned function is safe to call more than once.
+func (d *Drainer) trackRequest(r *http.Request) func() {
+	d.inflightMu.Lock()
+	if d.inflightReqs == nil {
+		d.inflightReqs = make(map[*http.Request]struct{})
+	}
+	d.inflightReqs[r] = struct{}{}
+	d.inflightMu.Unlock()
+	d.inflightWG.Add(1)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			d.inflightMu.Lock()
+			delete(d.inflightReqs, r)
+			d.inflightMu.Unlock()
+			d.inflightWG.Done()
+		})
+	}
+}
+
+// InFlight returns the number of requests Drainer has observed entering
+// ServeHTTP that have not yet finished (or, for hijacked connections,
+// have not yet been closed).
+func (d *Drainer) InFlight() int {
+	d.inflightMu.Lock()
+	defer d.inflightMu.Unlock()
+	return len(d.inflightReqs)
+}
+
+// inFlightRequests returns a snapshot of the requests Drainer currently
+// considers in-flight, for OnForceClose to report on.
+func (d *Drainer) inFlightRequests() []*http.Request {
+	d.inflightMu.Lock()
+	defer d.inflightMu.Unlock()
+	reqs := make([]*http.Request, 0, len(d.inflightReqs))
+	for r := range d.inflightReqs {
+		reqs = append(reqs, r)
+	}
+	return reqs
+}
+
+// inFlightWriter wraps a http.ResponseWriter so that a long-lived
+// connection taken over via Hijack (e.g. a WebSocket upgrade) is only
+// considered finished once the hijacked net.Conn is closed, rather than
+// when ServeHTTP returns.
+type inFlightWriter struct {
+	http.ResponseWriter
+
+	done     func()
+	hijacked bool
+}
+
+// Hijack implements http.Hijacker.
+func (w *inFlightWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter does not support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, rw, err
+	}
+	w.hijacked = true
+	return &trackedConn{Conn: conn, done: w.done}, rw, nil
+}
+
+// wrapInFlightWriter returns base, typed so that it additionally
+// implements whichever of http.Flusher and http.CloseNotifier the real
+// ResponseWriter w supports. Without this, wrapping w in base alone would
+// hide those optional interfaces from downstream code - e.g. an SSE
+// handler or httputil.ReverseProxy that type-asserts for http.Flusher to
+// stream chunks as they're written - breaking long-lived streaming
+// responses, which is exactly the traffic in-flight tracking exists to
+// accommodate.
+func wrapInFlightWriter(base *inFlightWriter, w http.ResponseWriter) http.ResponseWriter {
+	flusher, isFlusher := w.(http.Flusher)
+	notifier, isCloseNotifier := w.(http.CloseNotifier)
+	switch {
+	case isFlusher && isCloseNotifier:
+		return &flushCloseNotifyWriter{inFlightWriter: base, Flusher: flusher, CloseNotifier: notifier}
+	case isFlusher:
+		return &flushWriter{inFlightWriter: base, Flusher: flusher}
+	case isCloseNotifier:
+		return &closeNotifyWriter{inFlightWriter: base, CloseNotifier: notifier}
+	default:
+		return base
+	}
+}
+
+// flushWriter adds a Flush passthrough to inFlightWriter.
+type flushWriter struct {
+	*inFlightWriter
+	http.Flusher
+}
+
+// closeNotifyWriter adds a CloseNotify passthrough to inFlightWriter.
+type closeNotifyWriter struct {
+	*inFlightWriter
+	http.CloseNotifier
+}
+
+// flushCloseNotifyWriter adds both a Flush and a CloseNotify passthrough
+// to inFlightWriter.
+type flushCloseNotifyWriter struct {
+	*inFlightWriter
+	http.Flusher
+	http.CloseNotifier
+}
+
+// trackedConn marks a request as finished once the hijacked connection it
+// backs is closed.
+type trackedConn struct {
+	net.Conn
+
+	once sync.Once
+	done func()
+}
+
+// Close implements net.Conn.
+func (c *trackedConn) Close() error {
+	defer c.once.Do(c.done)
+	return c.Conn.Close()
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTrackRequestInFlight(t *testing.T) {
+	d := &Drainer{}
+	r := &http.Request{}
+
+	if got := d.InFlight(); got != 0 {
+		t.Fatalf("InFlight() = %d, want 0 before tracking", got)
+	}
+
+	done := d.trackRequest(r)
+	if got := d.InFlight(); got != 1 {
+		t.Errorf("InFlight() = %d, want 1", got)
+	}
+	if reqs := d.inFlightRequests(); len(reqs) != 1 || reqs[0] != r {
+		t.Errorf("inFlightRequests() = %v, want [%v]", reqs, r)
+	}
+
+	done()
+	if got := d.InFlight(); got != 0 {
+		t.Errorf("InFlight() = %d, want 0 after done", got)
+	}
+
+	// done must be safe to call more than once (e.g. ServeHTTP's deferred
+	// call racing a Hijacker's Close), and must not double-decrement.
+	done()
+	if got := d.InFlight(); got != 0 {
+		t.Errorf("InFlight() = %d, want 0 after second done", got)
+	}
+}
+
+func TestDrainerServeHTTPTracksInFlight(t *testing.T) {
+	release := make(chan struct{})
+	entered := make(chan struct{})
+	d := &Drainer{
+		Inner: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			close(entered)
+			<-release
+		}),
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+
+	<-entered
+	if got := d.InFlight(); got != 1 {
+		t.Errorf("InFlight() = %d, want 1 while handler is running", got)
+	}
+
+	close(release)
+	<-done
+	if got := d.InFlight(); got != 0 {
+		t.Errorf("InFlight() = %d, want 0 once handler returns", got)
+	}
+}
+
+// TestMaxDrainDurationForcesClose verifies that Drain returns once
+// MaxDrainDuration elapses, even with a request that never finishes on
+// its own, and that OnForceClose is told about it.
+func TestMaxDrainDurationForcesClose(t *testing.T) {
+	release := make(chan struct{})
+	entered := make(chan struct{})
+	var (
+		mu     sync.Mutex
+		forced []*http.Request
+	)
+
+	d := &Drainer{
+		QuietPeriod:      time.Hour, // Long enough to never elapse in this test.
+		MaxDrainDuration: 20 * time.Millisecond,
+		Inner: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			close(entered)
+			<-release
+		}),
+		OnForceClose: func(reqs []*http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			forced = reqs
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	go d.ServeHTTP(httptest.NewRecorder(), req)
+	<-entered
+
+	start := time.Now()
+	if err := d.Drain(); err != nil {
+		t.Errorf("Drain() = %v, want nil", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Drain() took %v, want well under QuietPeriod", elapsed)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(forced) != 1 || forced[0] != req {
+		t.Errorf("OnForceClose received %v, want [%v]", forced, req)
+	}
+
+	close(release)
+}
+
+// hijackableRecorder is an httptest.ResponseRecorder that also implements
+// http.Hijacker, for exercising inFlightWriter.Hijack.
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (h *hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	rw := bufio.NewReadWriter(bufio.NewReader(h.conn), bufio.NewWriter(h.conn))
+	return h.conn, rw, nil
+}
+
+func TestInFlightWriterHijack(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	var doneCalls int32
+	w := &inFlightWriter{
+		ResponseWriter: &hijackableRecorder{ResponseRecorder: httptest.NewRecorder(), conn: server},
+		done:           func() { atomic.AddInt32(&doneCalls, 1) },
+	}
+
+	conn, _, err := w.Hijack()
+	if err != nil {
+		t.Fatal("Hijack() error:", err)
+	}
+	if !w.hijacked {
+		t.Error("hijacked flag was not set")
+	}
+	if got := atomic.LoadInt32(&doneCalls); got != 0 {
+		t.Errorf("done called %d times before Close, want 0", got)
+	}
+
+	conn.Close()
+	if got := atomic.LoadInt32(&doneCalls); got != 1 {
+		t.Errorf("done called %d times after Close, want 1", got)
+	}
+
+	// trackedConn.Close must be idempotent.
+	conn.Close()
+	if got := atomic.LoadInt32(&doneCalls); got != 1 {
+		t.Errorf("done called %d times after second Close, want 1", got)
+	}
+}
+
+func TestInFlightWriterHijackUnsupported(t *testing.T) {
+	w := &inFlightWriter{ResponseWriter: httptest.NewRecorder(), done: func() {}}
+	if _, _, err := w.Hijack(); err == nil {
+		t.Error("Hijack() = nil error, want one since the underlying ResponseWriter can't be hijacked")
+	}
+}
+
+// plainResponseWriter implements only the core http.ResponseWriter
+// methods, none of the optional http.Flusher/http.CloseNotifier
+// interfaces.
+type plainResponseWriter struct {
+	header http.Header
+}
+
+func (p *plainResponseWriter) Header() http.Header         { return p.header }
+func (p *plainResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (p *plainResponseWriter) WriteHeader(int)             {}
+
+// closeNotifyResponseWriter implements http.CloseNotifier on top of the
+// core http.ResponseWriter methods, but not http.Flusher.
+type closeNotifyResponseWriter struct {
+	*plainResponseWriter
+	ch chan bool
+}
+
+func (c *closeNotifyResponseWriter) CloseNotify() <-chan bool { return c.ch }
+
+// TestWrapInFlightWriterForwardsFlush verifies that wrapping a
+// ResponseWriter which implements http.Flusher (such as
+// httptest.ResponseRecorder, or what httputil.ReverseProxy is handed in
+// practice) still satisfies http.Flusher afterward, so a streaming
+// handler's type assertion keeps working through a Drainer.
+func TestWrapInFlightWriterForwardsFlush(t *testing.T) {
+	rec := httptest.NewRecorder()
+	base := &inFlightWriter{ResponseWriter: rec, done: func() {}}
+	wrapped := wrapInFlightWriter(base, rec)
+
+	f, ok := wrapped.(http.Flusher)
+	if !ok {
+		t.Fatal("wrapped writer does not implement http.Flusher")
+	}
+	f.Flush()
+	if !rec.Flushed {
+		t.Error("Flush() was not forwarded to the underlying ResponseWriter")
+	}
+}
+
+func TestWrapInFlightWriterForwardsCloseNotify(t *testing.T) {
+	ch := make(chan bool, 1)
+	cn := &closeNotifyResponseWriter{plainResponseWriter: &plainResponseWriter{header: http.Header{}}, ch: ch}
+	base := &inFlightWriter{ResponseWriter: cn, done: func() {}}
+	wrapped := wrapInFlightWriter(base, cn)
+
+	n, ok := wrapped.(http.CloseNotifier)
+	if !ok {
+		t.Fatal("wrapped writer does not implement http.CloseNotifier")
+	}
+	ch <- true
+	select {
+	case <-n.CloseNotify():
+	default:
+		t.Error("CloseNotify() was not forwarded to the underlying ResponseWriter")
+	}
+
+	if _, ok := wrapped.(http.Flusher); ok {
+		t.Error("wrapped writer implements http.Flusher, but the underlying ResponseWriter doesn't")
+	}
+}
+
+func TestWrapInFlightWriterNoOptionalInterfaces(t *testing.T) {
+	w := &plainResponseWriter{header: http.Header{}}
+	base := &inFlightWriter{ResponseWriter: w, done: func() {}}
+	wrapped := wrapInFlightWriter(base, w)
+
+	if wrapped != http.ResponseWriter(base) {
+		t.Error("expected the base writer back unchanged when no optional interfaces are supported")
+	}
+	if _, ok := wrapped.(http.Flusher); ok {
+		t.Error("wrapped writer implements http.Flusher, but the underlying ResponseWriter doesn't")
+	}
+	if _, ok := wrapped.(http.CloseNotifier); ok {
+		t.Error("wrapped writer implements http.CloseNotifier, but the underlying ResponseWriter doesn't")
+	}
+}
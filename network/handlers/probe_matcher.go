@@ -0,0 +1,92 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"net/http"
+
+	"knative.dev/pkg/network"
+)
+
+// ProbeMatcher lets callers plug a custom probe or health-check format
+// (e.g. an AWS ELB, GCP HC, or Envoy /ready request) into ServeHTTP
+// alongside Knative's built-in kube-probe and k-network-probe handling.
+// Drainer.Probes is evaluated in slice order ahead of the built-in
+// kube-probe and k-network-probe handling, so a custom matcher can also
+// override them.
+type ProbeMatcher interface {
+	// Matches reports whether r is a probe this matcher answers.
+	Matches(r *http.Request) bool
+	// Serve answers the probe. draining reports whether the Drainer has
+	// started draining.
+	Serve(w http.ResponseWriter, r *http.Request, draining bool)
+}
+
+// KubeProbe matches kubelet's kube-probe/* health checks, plus any
+// additional user agent prefixes configured on it, and answers them the
+// same way Drainer.ServeHTTP's built-in health check handling does: 200
+// until draining, 503 once draining, or delegating to HealthCheck if set.
+type KubeProbe struct {
+	// UAPrefixes is a list of additional user agent prefixes to treat as
+	// health checks, on top of network.KubeProbeUAPrefix.
+	UAPrefixes []string
+
+	// HealthCheck, if set, serves non-draining requests instead of the
+	// default 200 OK.
+	HealthCheck http.Handler
+}
+
+// Matches implements ProbeMatcher.
+func (k KubeProbe) Matches(r *http.Request) bool {
+	return matchesHealthCheckUA(r.Header.Get(network.UserAgentKey), k.UAPrefixes)
+}
+
+// Serve implements ProbeMatcher.
+func (k KubeProbe) Serve(w http.ResponseWriter, r *http.Request, draining bool) {
+	if draining {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if k.HealthCheck != nil {
+		k.HealthCheck.ServeHTTP(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// KProbe matches Knative's own k-network-probe requests, the same ones
+// Drainer answers today via serveKProbe.
+type KProbe struct{}
+
+// Matches implements ProbeMatcher.
+func (KProbe) Matches(r *http.Request) bool { return isKProbe(r) }
+
+// Serve implements ProbeMatcher.
+func (KProbe) Serve(w http.ResponseWriter, r *http.Request, _ bool) { serveKProbe(w, r) }
+
+// ActivatorProbe matches probes the Knative activator sends directly to a
+// revision, identified by its distinct user agent, and answers them the
+// same way KProbe does.
+type ActivatorProbe struct{}
+
+// Matches implements ProbeMatcher.
+func (ActivatorProbe) Matches(r *http.Request) bool {
+	return r.Header.Get(network.UserAgentKey) == network.ActivatorUserAgent
+}
+
+// Serve implements ProbeMatcher.
+func (ActivatorProbe) Serve(w http.ResponseWriter, r *http.Request, _ bool) { serveKProbe(w, r) }
@@ -0,0 +1,189 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"knative.dev/pkg/network"
+)
+
+func TestKubeProbeMatches(t *testing.T) {
+	k := KubeProbe{UAPrefixes: []string{"extra"}}
+
+	tests := []struct {
+		name string
+		ua   string
+		want bool
+	}{
+		{"kube-probe prefix", network.KubeProbeUAPrefix + "1.20", true},
+		{"extra prefix", "extra-thing", true},
+		{"unrelated", "curl/7.0", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &http.Request{Header: http.Header{network.UserAgentKey: []string{tc.ua}}}
+			if got := k.Matches(req); got != tc.want {
+				t.Errorf("Matches() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestKubeProbeServe(t *testing.T) {
+	k := KubeProbe{}
+
+	resp := httptest.NewRecorder()
+	k.Serve(resp, &http.Request{}, false /* draining */)
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Errorf("Serve() status = %d, want %d when not draining", got, want)
+	}
+
+	resp = httptest.NewRecorder()
+	k.Serve(resp, &http.Request{}, true /* draining */)
+	if got, want := resp.Code, http.StatusServiceUnavailable; got != want {
+		t.Errorf("Serve() status = %d, want %d when draining", got, want)
+	}
+
+	k.HealthCheck = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	resp = httptest.NewRecorder()
+	k.Serve(resp, &http.Request{}, false /* draining */)
+	if got, want := resp.Code, http.StatusTeapot; got != want {
+		t.Errorf("Serve() status = %d, want %d from custom HealthCheck", got, want)
+	}
+}
+
+func TestKProbeMatcher(t *testing.T) {
+	kp := KProbe{}
+	req := &http.Request{Header: http.Header{network.ProbeHeaderName: []string{network.ProbeHeaderValue}}}
+	if !kp.Matches(req) {
+		t.Error("Matches() = false, want true for a k-network-probe request")
+	}
+	if kp.Matches(&http.Request{Header: http.Header{}}) {
+		t.Error("Matches() = true, want false for a non-probe request")
+	}
+
+	req.Header.Set(network.HashHeaderName, "hash")
+	resp := httptest.NewRecorder()
+	kp.Serve(resp, req, false)
+	if got, want := resp.Header().Get(network.HashHeaderName), "hash"; got != want {
+		t.Errorf("KProbe hash = %s, want %s", got, want)
+	}
+}
+
+func TestActivatorProbeMatcher(t *testing.T) {
+	ap := ActivatorProbe{}
+	req := &http.Request{Header: http.Header{network.UserAgentKey: []string{network.ActivatorUserAgent}}}
+	if !ap.Matches(req) {
+		t.Error("Matches() = false, want true for the activator's user agent")
+	}
+	if ap.Matches(&http.Request{Header: http.Header{network.UserAgentKey: []string{"other"}}}) {
+		t.Error("Matches() = true, want false for a different user agent")
+	}
+}
+
+// TestDrainerProbesTakePriority verifies that Drainer.Probes is evaluated
+// ahead of the built-in kube-probe and k-network-probe handling, so a
+// custom matcher can override them.
+func TestDrainerProbesTakePriority(t *testing.T) {
+	var served bool
+	override := fakeMatcher{
+		matches: func(r *http.Request) bool { return true },
+		serve: func(w http.ResponseWriter, r *http.Request, draining bool) {
+			served = true
+			w.WriteHeader(http.StatusTeapot)
+		},
+	}
+
+	d := &Drainer{
+		Inner:  http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}),
+		Probes: []ProbeMatcher{override},
+	}
+
+	kprobe := &http.Request{
+		Header: http.Header{
+			network.ProbeHeaderName: []string{network.ProbeHeaderValue},
+			network.HashHeaderName:  []string{"hash"},
+		},
+	}
+	resp := httptest.NewRecorder()
+	d.ServeHTTP(resp, kprobe)
+
+	if !served {
+		t.Error("custom ProbeMatcher was not consulted")
+	}
+	if got, want := resp.Code, http.StatusTeapot; got != want {
+		t.Errorf("status = %d, want %d from the custom matcher, not the built-in kprobe handling", got, want)
+	}
+}
+
+// TestDrainerEffectiveProbesIncludesBuiltins verifies that ServeHTTP's
+// default kube-probe and k-network-probe handling is actually implemented
+// via the built-in KProbe and KubeProbe matchers, not a separate
+// hard-coded path, by checking they show up in effectiveProbes() and
+// that KubeProbe picks up HealthCheckUAPrefixes/HealthCheck from the
+// Drainer.
+func TestDrainerEffectiveProbesIncludesBuiltins(t *testing.T) {
+	checker := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	d := &Drainer{
+		HealthCheckUAPrefixes: []string{"extra"},
+		HealthCheck:           checker,
+	}
+
+	probes := d.effectiveProbes()
+	if len(probes) != 2 {
+		t.Fatalf("effectiveProbes() = %d matchers, want 2 (KProbe, KubeProbe)", len(probes))
+	}
+	if _, ok := probes[0].(KProbe); !ok {
+		t.Errorf("effectiveProbes()[0] = %T, want KProbe", probes[0])
+	}
+	kp, ok := probes[1].(KubeProbe)
+	if !ok {
+		t.Fatalf("effectiveProbes()[1] = %T, want KubeProbe", probes[1])
+	}
+	if len(kp.UAPrefixes) != 1 || kp.UAPrefixes[0] != "extra" {
+		t.Errorf("KubeProbe.UAPrefixes = %v, want [extra]", kp.UAPrefixes)
+	}
+	if kp.HealthCheck == nil {
+		t.Error("KubeProbe.HealthCheck was not populated from Drainer.HealthCheck")
+	}
+
+	// A caller-supplied matcher in Probes still comes first.
+	override := fakeMatcher{matches: func(*http.Request) bool { return true }}
+	d.Probes = []ProbeMatcher{override}
+	probes = d.effectiveProbes()
+	if len(probes) != 3 {
+		t.Fatalf("effectiveProbes() = %d matchers, want 3 with a caller-supplied Probes entry", len(probes))
+	}
+	if _, ok := probes[0].(fakeMatcher); !ok {
+		t.Errorf("effectiveProbes()[0] = %T, want the caller-supplied matcher first", probes[0])
+	}
+}
+
+type fakeMatcher struct {
+	matches func(*http.Request) bool
+	serve   func(http.ResponseWriter, *http.Request, bool)
+}
+
+func (f fakeMatcher) Matches(r *http.Request) bool { return f.matches(r) }
+func (f fakeMatcher) Serve(w http.ResponseWriter, r *http.Request, draining bool) {
+	f.serve(w, r, draining)
+}
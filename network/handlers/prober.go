@@ -0,0 +1,169 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"knative.dev/pkg/network"
+)
+
+// DefaultProbeBackoff is used by Drainer.Drain to probe upstream targets
+// when ProbeBackoff is left unset.
+var DefaultProbeBackoff = ProbeBackoff{
+	Duration: 50 * time.Millisecond,
+	Factor:   1.4,
+	Steps:    25,
+	Cap:      network.DefaultDrainTimeout,
+}
+
+// ProbeBackoff configures the exponential backoff a Prober uses between
+// probe attempts. Steps bounds the number of attempts; Cap bounds the
+// delay between any two attempts regardless of how many steps preceded
+// it, so a caller-supplied ceiling is always respected.
+type ProbeBackoff struct {
+	Duration time.Duration
+	Factor   float64
+	Steps    int
+	Cap      time.Duration
+}
+
+// Prober sends the same k-network-probe requests that Drainer answers via
+// serveKProbe, but outward: to an upstream target such as a mesh sidecar
+// or the activator. It is used to confirm that an upstream has observed
+// this pod's state (identified by hash) before considering it safe to
+// stop serving, closing the propagation race where a pod goes unready
+// before its upstreams have noticed.
+type Prober struct {
+	// Transport is used to send probe requests. Defaults to
+	// http.DefaultTransport.
+	Transport http.RoundTripper
+
+	inflight sync.Map // target+"|"+hash -> *probeCall
+
+	successes uint64
+	failures  uint64
+}
+
+// probeCall tracks a single outstanding Do call for a target+hash, so
+// that concurrent callers sharing the same key share its outcome instead
+// of each issuing their own probe.
+type probeCall struct {
+	done chan struct{}
+	ok   bool
+	err  error
+}
+
+// Successes returns the number of probes run by Do that observed the
+// expected hash echoed back by the target. Concurrent Do calls that share
+// one probe count once.
+func (p *Prober) Successes() uint64 {
+	return atomic.LoadUint64(&p.successes)
+}
+
+// Failures returns the number of probes run by Do that gave up without
+// observing the expected hash. Concurrent Do calls that share one probe
+// count once.
+func (p *Prober) Failures() uint64 {
+	return atomic.LoadUint64(&p.failures)
+}
+
+// Do sends k-network-probe requests to target, retrying per backoff,
+// until target echoes hash back via the K-Network-Hash header, ctx is
+// canceled, or the backoff is exhausted. Concurrent calls sharing the
+// same target and hash dedupe onto a single outstanding probe: the
+// first caller in actually issues it, and every other caller waits for
+// and shares its result.
+func (p *Prober) Do(ctx context.Context, backoff ProbeBackoff, target, hash string) (bool, error) {
+	key := target + "|" + hash
+	call := &probeCall{done: make(chan struct{})}
+	actual, loaded := p.inflight.LoadOrStore(key, call)
+	if loaded {
+		call = actual.(*probeCall)
+		select {
+		case <-call.done:
+			return call.ok, call.err
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+	defer func() {
+		p.inflight.Delete(key)
+		close(call.done)
+	}()
+
+	transport := p.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	var ok bool
+	err := wait.ExponentialBackoff(wait.Backoff{
+		Duration: backoff.Duration,
+		Factor:   backoff.Factor,
+		Steps:    backoff.Steps,
+		Cap:      backoff.Cap,
+	}, func() (bool, error) {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return false, ctxErr
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set(network.ProbeHeaderName, network.ProbeHeaderValue)
+		req.Header.Set(network.HashHeaderName, hash)
+
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			// Treat transport errors as transient and keep retrying.
+			return false, nil
+		}
+		defer resp.Body.Close()
+
+		ok = resp.StatusCode == http.StatusOK && resp.Header.Get(network.HashHeaderName) == hash
+		return ok, nil
+	})
+
+	if ok {
+		atomic.AddUint64(&p.successes, 1)
+	} else {
+		atomic.AddUint64(&p.failures, 1)
+	}
+
+	if err != nil && err != wait.ErrWaitTimeout {
+		call.err = err
+	}
+	call.ok = ok
+	return call.ok, call.err
+}
+
+// AsyncProbe runs Do for target/hash in the background using backoff,
+// and invokes done with the outcome once it completes. It lets callers
+// kick off upstream probes without blocking on their completion.
+func (p *Prober) AsyncProbe(target, hash string, backoff ProbeBackoff, done func(bool)) {
+	go func() {
+		ok, _ := p.Do(context.Background(), backoff, target, hash)
+		done(ok)
+	}()
+}
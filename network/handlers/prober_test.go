@@ -0,0 +1,168 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"knative.dev/pkg/network"
+)
+
+type fakeRoundTripper struct {
+	fn func(*http.Request) (*http.Response, error)
+}
+
+func (f *fakeRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f.fn(r)
+}
+
+func TestProberDoSuccess(t *testing.T) {
+	const hash = "deadbeef"
+	p := &Prober{
+		Transport: &fakeRoundTripper{fn: func(r *http.Request) (*http.Response, error) {
+			resp := httptest.NewRecorder()
+			resp.Header().Set(network.HashHeaderName, hash)
+			resp.WriteHeader(http.StatusOK)
+			return resp.Result(), nil
+		}},
+	}
+
+	ok, err := p.Do(context.Background(), ProbeBackoff{Duration: time.Millisecond, Factor: 1, Steps: 1}, "http://example.com", hash)
+	if err != nil {
+		t.Fatalf("Do() returned error: %v", err)
+	}
+	if !ok {
+		t.Error("Do() = false, want true")
+	}
+	if got := p.Successes(); got != 1 {
+		t.Errorf("Successes() = %d, want 1", got)
+	}
+}
+
+func TestProberDoGivesUpAfterSteps(t *testing.T) {
+	var calls int32
+	p := &Prober{
+		Transport: &fakeRoundTripper{fn: func(r *http.Request) (*http.Response, error) {
+			atomic.AddInt32(&calls, 1)
+			resp := httptest.NewRecorder()
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return resp.Result(), nil
+		}},
+	}
+
+	ok, err := p.Do(context.Background(), ProbeBackoff{Duration: time.Millisecond, Factor: 1, Steps: 3}, "http://example.com", "hash")
+	if err != nil {
+		t.Fatalf("Do() returned error: %v", err)
+	}
+	if ok {
+		t.Error("Do() = true, want false")
+	}
+	if got := p.Failures(); got != 1 {
+		t.Errorf("Failures() = %d, want 1", got)
+	}
+	if got, want := atomic.LoadInt32(&calls), int32(3); got != want {
+		t.Errorf("RoundTrip called %d times, want %d", got, want)
+	}
+}
+
+// TestProberDoDedupes verifies that two concurrent Do calls for the same
+// target and hash share a single outstanding probe: only one RoundTrip
+// happens, and both callers get its result, rather than the loser of the
+// race being handed a synthetic failure.
+func TestProberDoDedupes(t *testing.T) {
+	const hash = "deadbeef"
+	var calls int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	p := &Prober{
+		Transport: &fakeRoundTripper{fn: func(r *http.Request) (*http.Response, error) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				close(started)
+				<-release
+			}
+			resp := httptest.NewRecorder()
+			resp.Header().Set(network.HashHeaderName, hash)
+			resp.WriteHeader(http.StatusOK)
+			return resp.Result(), nil
+		}},
+	}
+
+	backoff := ProbeBackoff{Duration: time.Millisecond, Factor: 1, Steps: 1}
+	var wg sync.WaitGroup
+	results := make([]bool, 2)
+	errs := make([]error, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		results[0], errs[0] = p.Do(context.Background(), backoff, "http://example.com", hash)
+	}()
+	go func() {
+		defer wg.Done()
+		<-started // Wait for the first call to actually be in flight.
+		results[1], errs[1] = p.Do(context.Background(), backoff, "http://example.com", hash)
+	}()
+
+	// Give the second caller time to join the in-flight call before we
+	// let the first RoundTrip complete.
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i := range results {
+		if errs[i] != nil {
+			t.Errorf("Do()[%d] returned error: %v", i, errs[i])
+		}
+		if !results[i] {
+			t.Errorf("Do()[%d] = false, want true (should share the winner's result)", i)
+		}
+	}
+	if got, want := atomic.LoadInt32(&calls), int32(1); got != want {
+		t.Errorf("RoundTrip called %d times, want %d (should have deduped)", got, want)
+	}
+}
+
+func TestProberAsyncProbe(t *testing.T) {
+	const hash = "deadbeef"
+	p := &Prober{
+		Transport: &fakeRoundTripper{fn: func(r *http.Request) (*http.Response, error) {
+			resp := httptest.NewRecorder()
+			resp.Header().Set(network.HashHeaderName, hash)
+			resp.WriteHeader(http.StatusOK)
+			return resp.Result(), nil
+		}},
+	}
+
+	done := make(chan bool, 1)
+	p.AsyncProbe("http://example.com", hash, ProbeBackoff{Duration: time.Millisecond, Factor: 1, Steps: 1}, func(ok bool) {
+		done <- ok
+	})
+
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("AsyncProbe callback got false, want true")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("AsyncProbe callback was never invoked")
+	}
+}